@@ -21,7 +21,6 @@ import (
 	"github.com/juju/errors"
 	"github.com/pingcap/tidb/context"
 	"github.com/pingcap/tidb/expression"
-	"github.com/pingcap/tidb/kv/memkv"
 	"github.com/pingcap/tidb/plan"
 	"github.com/pingcap/tidb/util/format"
 	"github.com/pingcap/tidb/util/types"
@@ -34,15 +33,18 @@ var (
 // DistinctDefaultPlan e.g. SELECT distinct(id) FROM t;
 type DistinctDefaultPlan struct {
 	*SelectList
-	Src    plan.Plan
-	rows   []*plan.Row
-	cursor int
+	Src   plan.Plan
+	keys  *distinctKeySet
+	stats distinctSpillStats
 }
 
 // Explain implements the plan.Plan Explain interface.
 func (r *DistinctDefaultPlan) Explain(w format.Formatter) {
 	r.Src.Explain(w)
 	w.Format("┌Compute distinct rows\n└Output field names %v\n", r.ResultFields)
+	if r.stats.spilled {
+		w.Format("└Spilled distinct keys to disk, %d bytes\n", r.stats.bytesOnDisk)
+	}
 }
 
 // Filter implements the plan.Plan Filter interface.
@@ -50,38 +52,32 @@ func (r *DistinctDefaultPlan) Filter(ctx context.Context, expr expression.Expres
 	return r, false, nil
 }
 
-// Do : Distinct plan use an in-memory temp table for storing items that has same
-// key, the value in temp table is an array of record handles.
+// Do : Distinct plan use a key set for storing keys that has already been
+// seen. The key set lives in memory until it grows past the session's
+// DistinctSpillConfig threshold, at which point it migrates to disk.
 func (r *DistinctDefaultPlan) Do(ctx context.Context, f plan.RowIterFunc) (err error) {
-	t, err := memkv.CreateTemp(true)
+	keys, err := newDistinctKeySet(GetDistinctSpillConfig(ctx))
 	if err != nil {
 		return
 	}
 
 	defer func() {
-		if derr := t.Drop(); derr != nil && err == nil {
+		if derr := keys.close(); derr != nil && err == nil {
 			err = derr
 		}
+		r.stats = keys.stats
 	}()
 
 	var rows [][]interface{}
 	if err = r.Src.Do(ctx, func(id interface{}, in []interface{}) (bool, error) {
-		var v []interface{}
-		// get distinct key
-		key := in[0:r.HiddenFieldOffset]
-		v, err = t.Get(key)
+		dup, err := keys.seen(in[0:r.HiddenFieldOffset])
 		if err != nil {
 			return false, err
 		}
-
-		if len(v) == 0 {
+		if !dup {
 			// no group for key, save data for this group
 			rows = append(rows, in)
-			if err := t.Set(key, []interface{}{true}); err != nil {
-				return false, err
-			}
 		}
-
 		return true, nil
 	}); err != nil {
 		return
@@ -97,56 +93,45 @@ func (r *DistinctDefaultPlan) Do(ctx context.Context, f plan.RowIterFunc) (err e
 }
 
 // Next implements plan.Plan Next interface.
+// Unlike Do, Next is pull-based: rows are deduplicated one at a time against
+// a temp table that lives for the lifetime of the plan, so a LIMIT above us
+// can stop pulling without ever materializing the whole distinct set.
 func (r *DistinctDefaultPlan) Next(ctx context.Context) (row *plan.Row, err error) {
-	if r.rows == nil {
-		err = r.fetchAll(ctx)
+	if r.keys == nil {
+		r.keys, err = newDistinctKeySet(GetDistinctSpillConfig(ctx))
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
 	}
-	if r.cursor == len(r.rows) {
-		return
-	}
-	row = r.rows[r.cursor]
-	r.cursor++
-	return
-}
 
-func (r *DistinctDefaultPlan) fetchAll(ctx context.Context) error {
-	t, err := memkv.CreateTemp(true)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	defer func() {
-		if derr := t.Drop(); derr != nil && err == nil {
-			err = derr
-		}
-	}()
 	for {
-		row, err := r.Src.Next(ctx)
+		row, err = r.Src.Next(ctx)
 		if row == nil || err != nil {
-			return errors.Trace(err)
+			return nil, errors.Trace(err)
 		}
-		var v []interface{}
-		// get distinct key
-		key := row.Data[0:r.HiddenFieldOffset]
-		v, err = t.Get(key)
+
+		var dup bool
+		dup, err = r.keys.seen(row.Data[0:r.HiddenFieldOffset])
 		if err != nil {
-			return errors.Trace(err)
+			return nil, errors.Trace(err)
 		}
-
-		if len(v) == 0 {
-			// no group for key, save data for this group
-			r.rows = append(r.rows, row)
-			if err := t.Set(key, []interface{}{true}); err != nil {
-				return errors.Trace(err)
-			}
+		r.stats = r.keys.stats
+		if dup {
+			// already seen this key, skip it
+			continue
 		}
+		return row, nil
 	}
 }
 
 // Close implements plan.Plan Close interface.
 func (r *DistinctDefaultPlan) Close() error {
+	if r.keys != nil {
+		if err := r.keys.close(); err != nil {
+			return errors.Trace(err)
+		}
+		r.keys = nil
+	}
 	return r.Src.Close()
 }
 
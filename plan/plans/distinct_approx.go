@@ -0,0 +1,123 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plans
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/plan"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/format"
+	"github.com/pingcap/tidb/util/hyperloglog"
+)
+
+var (
+	_ plan.Plan = (*DistinctApproxPlan)(nil)
+)
+
+type approxDistinctKey struct{}
+
+func (approxDistinctKey) String() string { return "tidb_approx_distinct" }
+
+// SetApproxDistinct sets the tidb_approx_distinct session variable on ctx.
+// When on, the planner may replace DistinctDefaultPlan with DistinctApproxPlan
+// for queries whose only consumer of the distinct rows is COUNT.
+func SetApproxDistinct(ctx context.Context, on bool) {
+	ctx.SetValue(approxDistinctKey{}, on)
+}
+
+// ApproxDistinct reports whether the tidb_approx_distinct session variable is
+// set on ctx. It defaults to false: exact DISTINCT remains the default.
+func ApproxDistinct(ctx context.Context) bool {
+	v := ctx.Value(approxDistinctKey{})
+	on, ok := v.(bool)
+	return ok && on
+}
+
+// DistinctApproxPlan answers SELECT COUNT(DISTINCT col...) FROM t (and the
+// APPROX_COUNT_DISTINCT aggregate) without materializing the distinct key
+// set: it feeds every row's distinct key into a HyperLogLog sketch and emits
+// a single row holding the estimated cardinality. Built via NewDistinctPlan,
+// which only chooses this over DistinctDefaultPlan when the distinct rows
+// themselves are never observed, just their count, and the
+// tidb_approx_distinct session variable is on.
+type DistinctApproxPlan struct {
+	*SelectList
+	Src  plan.Plan
+	done bool
+}
+
+// Explain implements the plan.Plan Explain interface.
+func (r *DistinctApproxPlan) Explain(w format.Formatter) {
+	r.Src.Explain(w)
+	w.Format("┌Compute approximate distinct row count (HyperLogLog, p=%d)\n└Output field names %v\n", hyperloglog.DefaultPrecision, r.ResultFields)
+}
+
+// Filter implements the plan.Plan Filter interface.
+func (r *DistinctApproxPlan) Filter(ctx context.Context, expr expression.Expression) (plan.Plan, bool, error) {
+	return r, false, nil
+}
+
+func (r *DistinctApproxPlan) estimate(ctx context.Context) (uint64, error) {
+	sketch := hyperloglog.New(hyperloglog.DefaultPrecision)
+	err := r.Src.Do(ctx, func(id interface{}, in []interface{}) (bool, error) {
+		key, err := codec.EncodeKey(nil, in[0:r.HiddenFieldOffset]...)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		sketch.Insert(key)
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return sketch.Estimate(), nil
+}
+
+// Do implements the plan.Plan Do interface. It emits exactly one row holding
+// the estimated distinct count.
+func (r *DistinctApproxPlan) Do(ctx context.Context, f plan.RowIterFunc) error {
+	count, err := r.estimate(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = f(nil, []interface{}{count})
+	return errors.Trace(err)
+}
+
+// Next implements plan.Plan Next interface. It returns the single estimate
+// row on the first call and nil thereafter.
+func (r *DistinctApproxPlan) Next(ctx context.Context) (row *plan.Row, err error) {
+	if r.done {
+		return nil, nil
+	}
+	r.done = true
+
+	count, err := r.estimate(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &plan.Row{Data: []interface{}{count}}, nil
+}
+
+// Close implements plan.Plan Close interface.
+func (r *DistinctApproxPlan) Close() error {
+	return r.Src.Close()
+}
+
+// UseNext implements NextPlan interface.
+func (r *DistinctApproxPlan) UseNext() bool {
+	return plan.UseNext(r.Src)
+}
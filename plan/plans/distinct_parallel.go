@@ -0,0 +1,390 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plans
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/plan"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/format"
+)
+
+var (
+	_ plan.Plan = (*DistinctParallelPlan)(nil)
+)
+
+type distinctConcurrencyKey struct{}
+
+func (distinctConcurrencyKey) String() string { return "tidb_distinct_concurrency" }
+
+// SetDistinctConcurrency sets the tidb_distinct_concurrency session
+// variable: the number of partition workers DistinctParallelPlan fans out
+// into.
+func SetDistinctConcurrency(ctx context.Context, n int) {
+	ctx.SetValue(distinctConcurrencyKey{}, n)
+}
+
+// DistinctConcurrency returns the tidb_distinct_concurrency session
+// variable, defaulting to 1 (serial) when it hasn't been set.
+func DistinctConcurrency(ctx context.Context) int {
+	v := ctx.Value(distinctConcurrencyKey{})
+	n, ok := v.(int)
+	if !ok || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// distinctPartitionBuf bounds how many rows a dispatcher or worker may get
+// ahead of its reader before blocking.
+const distinctPartitionBuf = 128
+
+// DistinctParallelPlan fans a DISTINCT scan out across N partition workers,
+// each deduping the rows whose distinct key hashes to its partition
+// (hash(key) % N) in its own memkv temp table. A single dispatcher goroutine
+// pulls from Src and routes every row to its partition over a buffered
+// channel; a merger goroutine round-robins the partitions' deduped output
+// back to Next/Do. It falls back to DistinctDefaultPlan when
+// tidb_distinct_concurrency is 1 or Src cannot be driven by a single pulling
+// goroutine.
+//
+// done is closed exactly once, by cancel, to tell the dispatcher, every
+// worker and the merger to stop: a caller that abandons Next/Do early (a
+// LIMIT above us, or an error elsewhere in the query) must not leave those
+// goroutines, their memkv temp tables or any spilled leveldb directories
+// running forever.
+type DistinctParallelPlan struct {
+	*SelectList
+	Src plan.Plan
+
+	once      sync.Once
+	rows      chan *plan.Row
+	errc      chan error
+	done      chan struct{}
+	closeDone sync.Once
+	serial    *DistinctDefaultPlan
+	n         int
+	parts     []*distinctPartition
+}
+
+// Explain implements the plan.Plan Explain interface.
+func (r *DistinctParallelPlan) Explain(w format.Formatter) {
+	r.Src.Explain(w)
+	if r.n > 1 {
+		w.Format("┌Compute distinct rows (%d-way parallel)\n└Output field names %v\n", r.n, r.ResultFields)
+	} else {
+		w.Format("┌Compute distinct rows\n└Output field names %v\n", r.ResultFields)
+	}
+	if stats := r.spillStats(); stats.spilled {
+		w.Format("└Spilled distinct keys to disk, %d bytes across %d partitions\n", stats.bytesOnDisk, len(r.parts))
+	}
+}
+
+// spillStats aggregates every partition's distinctSpillStats: spilled is set
+// if any partition spilled, bytesOnDisk is the sum across all of them. Like
+// DistinctDefaultPlan.Explain (distinct.go), this is how chunk0-2's spill
+// visibility requirement is satisfied here.
+func (r *DistinctParallelPlan) spillStats() distinctSpillStats {
+	var agg distinctSpillStats
+	for _, p := range r.parts {
+		agg.spilled = agg.spilled || p.keys.stats.spilled
+		agg.bytesOnDisk += p.keys.stats.bytesOnDisk
+	}
+	return agg
+}
+
+// Filter implements the plan.Plan Filter interface.
+func (r *DistinctParallelPlan) Filter(ctx context.Context, expr expression.Expression) (plan.Plan, bool, error) {
+	return r, false, nil
+}
+
+func (r *DistinctParallelPlan) fallback() *DistinctDefaultPlan {
+	if r.serial == nil {
+		r.serial = &DistinctDefaultPlan{SelectList: r.SelectList, Src: r.Src}
+	}
+	return r.serial
+}
+
+func hashDistinctKey(key []interface{}) (uint64, error) {
+	b, err := codec.EncodeKey(nil, key...)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64(), nil
+}
+
+// partitionSpillConfig divides cfg's memory threshold across n partitions,
+// so that an N-way DistinctParallelPlan still honors the session's overall
+// DistinctSpillConfig.Threshold instead of allowing each partition to
+// accumulate up to Threshold bytes on its own (N x the configured quota).
+func partitionSpillConfig(cfg *DistinctSpillConfig, n int) *DistinctSpillConfig {
+	if cfg == nil || cfg.Threshold <= 0 {
+		return cfg
+	}
+	partitioned := *cfg
+	partitioned.Threshold /= int64(n)
+	if partitioned.Threshold < 1 {
+		// Threshold <= 0 would disable spilling in every partition.
+		partitioned.Threshold = 1
+	}
+	return &partitioned
+}
+
+// distinctPartition is one worker's slice of the key space: rows come in on
+// in, deduped rows go out on out, and keys tracks which distinct keys this
+// partition has already seen.
+type distinctPartition struct {
+	in   chan *plan.Row
+	out  chan *plan.Row
+	keys *distinctKeySet
+}
+
+// cancel tells the dispatcher, every worker and the merger to stop, exactly
+// once. It is always safe to call, including after run has never been
+// called or after everything has already finished on its own.
+func (r *DistinctParallelPlan) cancel() {
+	if r.done == nil {
+		return
+	}
+	r.closeDone.Do(func() {
+		close(r.done)
+	})
+}
+
+// reportErr delivers err on errc without blocking - errc is created with
+// capacity 1, so the first error is always captured - and cancels the rest
+// of the pipeline so nothing is left consuming p.in/p.out/rows after a
+// failure.
+func (r *DistinctParallelPlan) reportErr(err error) {
+	select {
+	case r.errc <- err:
+	default:
+	}
+	r.cancel()
+}
+
+// run starts the dispatcher, the n worker goroutines and the merger. Rows
+// are read from r.rows, the first error (if any) from r.errc, both readable
+// once run returns with a nil error.
+func (r *DistinctParallelPlan) run(ctx context.Context, n int) error {
+	cfg := partitionSpillConfig(GetDistinctSpillConfig(ctx), n)
+
+	parts := make([]*distinctPartition, n)
+	for i := range parts {
+		keys, err := newDistinctKeySet(cfg)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		parts[i] = &distinctPartition{
+			in:   make(chan *plan.Row, distinctPartitionBuf),
+			out:  make(chan *plan.Row, distinctPartitionBuf),
+			keys: keys,
+		}
+	}
+
+	r.done = make(chan struct{})
+	r.errc = make(chan error, 1)
+	r.parts = parts
+
+	for _, p := range parts {
+		go r.runWorker(p)
+	}
+	go r.runDispatcher(ctx, parts, n)
+
+	r.rows = make(chan *plan.Row, distinctPartitionBuf)
+	go mergeDistinctPartitions(parts, r.rows, r.done)
+
+	return nil
+}
+
+// runWorker drains p.in, deduping each row against p's own key set, until
+// p.in is closed, a seen() error occurs, or cancel is called.
+func (r *DistinctParallelPlan) runWorker(p *distinctPartition) {
+	defer close(p.out)
+	defer func() {
+		if err := p.keys.close(); err != nil {
+			r.reportErr(errors.Trace(err))
+		}
+	}()
+
+	for {
+		select {
+		case row, ok := <-p.in:
+			if !ok {
+				return
+			}
+			dup, err := p.keys.seen(row.Data[0:r.HiddenFieldOffset])
+			if err != nil {
+				// Stop consuming on the first error: a persistent failure
+				// (e.g. disk full after a spill) would otherwise generate
+				// one error per remaining row.
+				r.reportErr(errors.Trace(err))
+				return
+			}
+			if !dup {
+				select {
+				case p.out <- row:
+				case <-r.done:
+					return
+				}
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// runDispatcher pulls rows from Src, the only goroutine allowed to do so,
+// and routes each to the partition its distinct key hashes to.
+func (r *DistinctParallelPlan) runDispatcher(ctx context.Context, parts []*distinctPartition, n int) {
+	defer func() {
+		for _, p := range parts {
+			close(p.in)
+		}
+	}()
+	for {
+		row, err := r.Src.Next(ctx)
+		if err != nil {
+			r.reportErr(errors.Trace(err))
+			return
+		}
+		if row == nil {
+			return
+		}
+		h, err := hashDistinctKey(row.Data[0:r.HiddenFieldOffset])
+		if err != nil {
+			r.reportErr(errors.Trace(err))
+			return
+		}
+		select {
+		case parts[h%uint64(n)].in <- row:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// mergeDistinctPartitions round-robins the deduped output of every
+// partition into rows, skipping partitions as they drain, and closes rows
+// once every partition has or done is closed.
+func mergeDistinctPartitions(parts []*distinctPartition, rows chan *plan.Row, done chan struct{}) {
+	defer close(rows)
+
+	open := make([]bool, len(parts))
+	remaining := len(parts)
+	for i := range open {
+		open[i] = true
+	}
+	for i := 0; remaining > 0; i = (i + 1) % len(parts) {
+		if !open[i] {
+			continue
+		}
+		select {
+		case row, ok := <-parts[i].out:
+			if !ok {
+				open[i] = false
+				remaining--
+				continue
+			}
+			select {
+			case rows <- row:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func firstErr(errc chan error) error {
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Do implements the plan.Plan Do interface.
+func (r *DistinctParallelPlan) Do(ctx context.Context, f plan.RowIterFunc) error {
+	n := DistinctConcurrency(ctx)
+	if n <= 1 || !plan.UseNext(r.Src) {
+		return r.fallback().Do(ctx, f)
+	}
+	r.n = n
+
+	if err := r.run(ctx, n); err != nil {
+		return errors.Trace(err)
+	}
+	// cancel unblocks the dispatcher/workers/merger on every return path,
+	// including the LIMIT short-circuit where f returns more == false.
+	defer r.cancel()
+
+	for row := range r.rows {
+		more, err := f(nil, row.Data)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !more {
+			break
+		}
+	}
+	return errors.Trace(firstErr(r.errc))
+}
+
+// Next implements plan.Plan Next interface.
+func (r *DistinctParallelPlan) Next(ctx context.Context) (row *plan.Row, err error) {
+	n := DistinctConcurrency(ctx)
+	if n <= 1 || !plan.UseNext(r.Src) {
+		return r.fallback().Next(ctx)
+	}
+	r.n = n
+
+	r.once.Do(func() {
+		err = r.run(ctx, n)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	row, ok := <-r.rows
+	if !ok {
+		return nil, errors.Trace(firstErr(r.errc))
+	}
+	return row, nil
+}
+
+// Close implements plan.Plan Close interface. It cancels any still-running
+// dispatcher/worker/merger goroutines - the caller may be abandoning Next
+// early, e.g. because of a LIMIT - before closing Src.
+func (r *DistinctParallelPlan) Close() error {
+	if r.serial != nil {
+		return r.serial.Close()
+	}
+	r.cancel()
+	return r.Src.Close()
+}
+
+// UseNext implements NextPlan interface.
+func (r *DistinctParallelPlan) UseNext() bool {
+	return true
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plans
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/mock"
+	"github.com/pingcap/tidb/plan"
+	"github.com/pingcap/tidb/util/format"
+)
+
+// benchDistinctSrc feeds n rows, each a single distinct-key column cycling
+// through `distinct` values, so DistinctParallelPlan's scaling can be
+// benchmarked without a real table or executor underneath it.
+type benchDistinctSrc struct {
+	n, distinct, cursor int
+}
+
+func (s *benchDistinctSrc) Explain(w format.Formatter) {}
+
+func (s *benchDistinctSrc) Filter(ctx context.Context, expr expression.Expression) (plan.Plan, bool, error) {
+	return s, false, nil
+}
+
+func (s *benchDistinctSrc) Do(ctx context.Context, f plan.RowIterFunc) error {
+	for s.cursor < s.n {
+		more, err := f(nil, []interface{}{s.cursor % s.distinct})
+		s.cursor++
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *benchDistinctSrc) Next(ctx context.Context) (*plan.Row, error) {
+	if s.cursor >= s.n {
+		return nil, nil
+	}
+	row := &plan.Row{Data: []interface{}{s.cursor % s.distinct}}
+	s.cursor++
+	return row, nil
+}
+
+func (s *benchDistinctSrc) Close() error { return nil }
+
+// UseNext implements NextPlan interface, so DistinctParallelPlan can drive
+// this source via its own dispatcher goroutine instead of falling back.
+func (s *benchDistinctSrc) UseNext() bool { return true }
+
+func (s *benchDistinctSrc) reset() { s.cursor = 0 }
+
+// drain pulls p to completion via Next, discarding rows.
+func drain(b *testing.B, ctx context.Context, p plan.Plan) {
+	for {
+		row, err := p.Next(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if row == nil {
+			return
+		}
+	}
+}
+
+// benchmarkDistinct drives NewDistinctPlan over a wide, low-cardinality
+// result set at the given tidb_distinct_concurrency, demonstrating how
+// DistinctParallelPlan scales relative to the serial DistinctDefaultPlan.
+func benchmarkDistinct(b *testing.B, concurrency int) {
+	const rows = 200000
+	const distinctValues = 20000
+
+	ctx := mock.NewContext()
+	SetDistinctConcurrency(ctx, concurrency)
+
+	sl := &SelectList{HiddenFieldOffset: 1}
+	src := &benchDistinctSrc{n: rows, distinct: distinctValues}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.reset()
+		p := NewDistinctPlan(ctx, sl, src, false)
+		drain(b, ctx, p)
+		if err := p.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDistinctSerial(b *testing.B)    { benchmarkDistinct(b, 1) }
+func BenchmarkDistinctParallel2(b *testing.B) { benchmarkDistinct(b, 2) }
+func BenchmarkDistinctParallel4(b *testing.B) { benchmarkDistinct(b, 4) }
+func BenchmarkDistinctParallel8(b *testing.B) { benchmarkDistinct(b, 8) }
@@ -0,0 +1,38 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plans
+
+import (
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/plan"
+)
+
+// NewDistinctPlan builds the plan that dedupes src's rows. The plan builder
+// should call this instead of constructing DistinctDefaultPlan directly, so
+// that DISTINCT queries pick up tidb_approx_distinct and
+// tidb_distinct_concurrency.
+//
+// onlyCount must be true only when sl's rows are never observed directly -
+// just their count, e.g. SELECT COUNT(DISTINCT col...) FROM t - since that
+// is the only case DistinctApproxPlan's HyperLogLog estimate is a correct
+// substitute for the exact row set.
+func NewDistinctPlan(ctx context.Context, sl *SelectList, src plan.Plan, onlyCount bool) plan.Plan {
+	if onlyCount && ApproxDistinct(ctx) {
+		return &DistinctApproxPlan{SelectList: sl, Src: src}
+	}
+	if DistinctConcurrency(ctx) > 1 {
+		return &DistinctParallelPlan{SelectList: sl, Src: src}
+	}
+	return &DistinctDefaultPlan{SelectList: sl, Src: src}
+}
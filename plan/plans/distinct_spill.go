@@ -0,0 +1,221 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plans
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/snappy"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/kv/memkv"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// DistinctSpillConfig controls when the distinct key set built by
+// DistinctDefaultPlan spills from its in-memory memkv temp table to an
+// on-disk KV store. It is looked up on the session context, so it can be
+// changed per-session without touching global state.
+type DistinctSpillConfig struct {
+	// Threshold is the approximate number of key bytes the in-memory temp
+	// table may hold before the key set migrates to disk. Threshold <= 0
+	// disables spilling.
+	Threshold int64
+	// TempDir is the directory spill files are created under. An empty
+	// TempDir uses the OS default temp directory.
+	TempDir string
+	// Compress snappy-compresses key bytes before they are written to the
+	// on-disk store.
+	Compress bool
+}
+
+type distinctSpillConfigKey struct{}
+
+func (distinctSpillConfigKey) String() string { return "distinct_spill_config" }
+
+// SetDistinctSpillConfig stores cfg on ctx for use by subsequent distinct
+// plans built in this session.
+func SetDistinctSpillConfig(ctx context.Context, cfg *DistinctSpillConfig) {
+	ctx.SetValue(distinctSpillConfigKey{}, cfg)
+}
+
+// GetDistinctSpillConfig returns the DistinctSpillConfig previously stored on
+// ctx, or nil if none was set, in which case spilling is disabled.
+func GetDistinctSpillConfig(ctx context.Context) *DistinctSpillConfig {
+	v := ctx.Value(distinctSpillConfigKey{})
+	if v == nil {
+		return nil
+	}
+	return v.(*DistinctSpillConfig)
+}
+
+// distinctSpillStats summarizes whether a distinct key set spilled to disk,
+// for reporting through Explain.
+type distinctSpillStats struct {
+	spilled     bool
+	bytesOnDisk int64
+}
+
+// distinctKeySet dedupes distinct keys. It starts out backed by an in-memory
+// memkv.Temp table and, once cfg.Threshold is exceeded, migrates the whole
+// key set to an on-disk leveldb store so a single large DISTINCT does not
+// grow the process's memory without bound.
+type distinctKeySet struct {
+	cfg   *DistinctSpillConfig
+	mem   memkv.Temp
+	disk  *leveldb.DB
+	dir   string
+	bytes int64
+	stats distinctSpillStats
+}
+
+func newDistinctKeySet(cfg *DistinctSpillConfig) (*distinctKeySet, error) {
+	t, err := memkv.CreateTemp(true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &distinctKeySet{cfg: cfg, mem: t}, nil
+}
+
+// seen reports whether key has already been inserted into the set, and
+// inserts it if not.
+func (s *distinctKeySet) seen(key []interface{}) (bool, error) {
+	k, err := codec.EncodeKey(nil, key...)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if s.disk != nil {
+		return s.seenDisk(k)
+	}
+
+	v, err := s.mem.Get(key)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if len(v) != 0 {
+		return true, nil
+	}
+	if err := s.mem.Set(key, []interface{}{true}); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if s.cfg != nil && s.cfg.Threshold > 0 {
+		s.bytes += int64(len(k))
+		if s.bytes > s.cfg.Threshold {
+			if err := s.spill(); err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+	}
+	return false, nil
+}
+
+// spill migrates every key currently in the in-memory temp table to an
+// on-disk leveldb store and drops the temp table.
+func (s *distinctKeySet) spill() (err error) {
+	s.dir, err = ioutil.TempDir(s.cfg.TempDir, "tidb_distinct_spill")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.disk, err = leveldb.OpenFile(s.dir, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	enum, err := s.mem.SeekFirst()
+	if err != nil && errors.Cause(err) != io.EOF {
+		return errors.Trace(err)
+	}
+	for err == nil {
+		var k []interface{}
+		k, _, err = enum.Next()
+		if err != nil {
+			break
+		}
+		var eb []byte
+		eb, err = codec.EncodeKey(nil, k...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = s.putDisk(eb); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err != nil && errors.Cause(err) != io.EOF {
+		return errors.Trace(err)
+	}
+
+	if err := s.mem.Drop(); err != nil {
+		return errors.Trace(err)
+	}
+	s.mem = nil
+	s.stats.spilled = true
+	return nil
+}
+
+// diskKey applies the configured compression, if any, to k. The on-disk
+// store only ever needs to answer "have we seen this key", so k is used as
+// the leveldb key and the value is left empty - there is nothing to read
+// back, so storing a second copy of k as the value would just waste disk
+// space.
+func (s *distinctKeySet) diskKey(k []byte) []byte {
+	if s.cfg.Compress {
+		return snappy.Encode(nil, k)
+	}
+	return k
+}
+
+func (s *distinctKeySet) putDisk(k []byte) error {
+	dk := s.diskKey(k)
+	s.stats.bytesOnDisk += int64(len(dk))
+	return errors.Trace(s.disk.Put(dk, nil, nil))
+}
+
+func (s *distinctKeySet) seenDisk(k []byte) (bool, error) {
+	_, err := s.disk.Get(s.diskKey(k), nil)
+	if err == nil {
+		return true, nil
+	}
+	if err != leveldb.ErrNotFound {
+		return false, errors.Trace(err)
+	}
+	if err := s.putDisk(k); err != nil {
+		return false, errors.Trace(err)
+	}
+	return false, nil
+}
+
+// close releases the in-memory and/or on-disk resources held by the set.
+func (s *distinctKeySet) close() error {
+	if s.mem != nil {
+		if err := s.mem.Drop(); err != nil {
+			return errors.Trace(err)
+		}
+		s.mem = nil
+	}
+	if s.disk != nil {
+		if err := s.disk.Close(); err != nil {
+			return errors.Trace(err)
+		}
+		s.disk = nil
+		if err := os.RemoveAll(s.dir); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hyperloglog
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// insertN inserts n distinct items, "item-0" through "item-(n-1)", into s.
+func insertN(s *Sketch, n int) {
+	for i := 0; i < n; i++ {
+		s.Insert([]byte("item-" + strconv.Itoa(i)))
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	// The standard error of a HyperLogLog sketch is about 1.04/sqrt(m); at
+	// the default precision (m = 16384) that's well under 1%, but small
+	// cardinalities also go through the small-range correction, so give
+	// those a wider berth.
+	cases := []struct {
+		card      int
+		tolerance float64
+	}{
+		{0, 0},
+		{1, 1},
+		{10, 0.5},
+		{100, 0.2},
+		{1000, 0.1},
+		{10000, 0.05},
+		{100000, 0.05},
+		{1000000, 0.05},
+	}
+
+	for _, c := range cases {
+		t.Run(strconv.Itoa(c.card), func(t *testing.T) {
+			s := New(DefaultPrecision)
+			insertN(s, c.card)
+			got := s.Estimate()
+
+			if c.card == 0 {
+				if got != 0 {
+					t.Fatalf("Estimate() = %d, want 0 for an empty sketch", got)
+				}
+				return
+			}
+
+			want := float64(c.card)
+			diff := math.Abs(float64(got) - want)
+			if diff > want*c.tolerance {
+				t.Fatalf("Estimate() = %d, want within %.0f%% of %d", got, c.tolerance*100, c.card)
+			}
+		})
+	}
+}
+
+// TestEstimateStable checks that inserting the same items twice doesn't
+// change the estimate: Insert must be idempotent per distinct key.
+func TestEstimateStable(t *testing.T) {
+	s := New(DefaultPrecision)
+	insertN(s, 5000)
+	first := s.Estimate()
+	insertN(s, 5000)
+	second := s.Estimate()
+
+	if first != second {
+		t.Fatalf("Estimate() changed from %d to %d after re-inserting the same keys", first, second)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const perSketch = 5000
+
+	// a and b share no keys; merging them should estimate close to their
+	// combined cardinality.
+	a := New(DefaultPrecision)
+	for i := 0; i < perSketch; i++ {
+		a.Insert([]byte("a-" + strconv.Itoa(i)))
+	}
+	b := New(DefaultPrecision)
+	for i := 0; i < perSketch; i++ {
+		b.Insert([]byte("b-" + strconv.Itoa(i)))
+	}
+
+	a.Merge(b)
+	got := a.Estimate()
+	want := float64(2 * perSketch)
+	if diff := math.Abs(float64(got) - want); diff > want*0.05 {
+		t.Fatalf("Merge().Estimate() = %d, want within 5%% of %d", got, 2*perSketch)
+	}
+}
+
+// TestMergeOverlapping checks that merging in a sketch of keys s has already
+// seen does not inflate the estimate.
+func TestMergeOverlapping(t *testing.T) {
+	s := New(DefaultPrecision)
+	insertN(s, 2000)
+	before := s.Estimate()
+
+	dup := New(DefaultPrecision)
+	insertN(dup, 2000)
+	s.Merge(dup)
+
+	after := s.Estimate()
+	if before != after {
+		t.Fatalf("Merge() of an identical key set changed the estimate from %d to %d", before, after)
+	}
+}
+
+// TestMergeMismatchedPrecision checks that Merge is a no-op, rather than a
+// panic or silent corruption, when the two sketches don't share precision.
+func TestMergeMismatchedPrecision(t *testing.T) {
+	s := New(DefaultPrecision)
+	insertN(s, 1000)
+	before := s.Estimate()
+
+	other := New(DefaultPrecision - 1)
+	insertN(other, 1000)
+	s.Merge(other)
+
+	if got := s.Estimate(); got != before {
+		t.Fatalf("Merge() with mismatched precision changed the estimate from %d to %d", before, got)
+	}
+
+	s.Merge(nil)
+	if got := s.Estimate(); got != before {
+		t.Fatalf("Merge(nil) changed the estimate from %d to %d", before, got)
+	}
+}